@@ -0,0 +1,57 @@
+package caskdb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ligadous/caskdb/storage/mem"
+)
+
+// Regression test for the batch footer: scanBatchRecords used to
+// accept any run of count well-formed records regardless of whether
+// the batch that framed them actually finished writing, so a torn
+// write that happened to land a complete set of records (but never
+// got to write a real footer) would still be indexed. Here we hand-
+// assemble a batch whose footer doesn't match its header's sequence
+// number, the way such a torn write would leave it, and confirm
+// Start() refuses to index it.
+func TestStartRejectsBatchWithMismatchedFooter(t *testing.T) {
+	s := mem.New()
+
+	pq, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+
+	f := pq.File
+
+	var buf bytes.Buffer
+	buf.Write([]byte(BATCHMAGIC))
+	buf.Write([]byte(fmt.Sprintf("%0*d", batchSeqDigits, uint64(1))))
+	buf.Write([]byte(fmt.Sprintf("%0*d", batchCntDigits, 2)))
+	buf.Write(pq.encodeRecordFor(f, "a", []byte("1")))
+	buf.Write(pq.encodeRecordFor(f, "b", []byte("2")))
+	// A real Write would repeat seq (1) here; this is what a crash
+	// mid-footer could leave behind instead.
+	buf.Write([]byte(fmt.Sprintf("%0*d", batchSeqDigits, uint64(0))))
+
+	pool := *pq.PoolFH
+	if _, err := pool[f].W.Write(buf.Bytes()); err != nil {
+		t.Fatalf("write raw batch: %v", err)
+	}
+
+	if err := pq.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	pq2, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("reopen NewStorage: %v", err)
+	}
+	defer pq2.Close()
+
+	if v, err := pq2.Get("a"); err == nil {
+		t.Fatalf("Get a = %q, nil; want error (batch with mismatched footer must not be indexed)", v)
+	}
+}
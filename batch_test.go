@@ -0,0 +1,82 @@
+package caskdb
+
+import (
+	"testing"
+
+	"github.com/ligadous/caskdb/storage/mem"
+)
+
+func TestWriteBatchCommitsAllOps(t *testing.T) {
+	pq, err := NewStorage("", mem.New())
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	defer pq.Close()
+
+	if err := pq.Put("c", []byte("stale")); err != nil {
+		t.Fatalf("Put c: %v", err)
+	}
+
+	var b Batch
+	b.Put("a", []byte("1"))
+	b.Put("b", []byte("2"))
+	b.Delete("c")
+
+	if got := b.Len(); got != 3 {
+		t.Fatalf("Len() = %d, want 3", got)
+	}
+
+	if err := pq.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	v, err := pq.Get("a")
+	if err != nil || string(v) != "1" {
+		t.Fatalf("Get a = %q, %v; want %q, nil", v, err, "1")
+	}
+
+	v, err = pq.Get("b")
+	if err != nil || string(v) != "2" {
+		t.Fatalf("Get b = %q, %v; want %q, nil", v, err, "2")
+	}
+
+	if _, err := pq.Get("c"); err == nil {
+		t.Fatalf("Get c: want error (deleted by batch), got nil")
+	}
+}
+
+func TestWriteBatchSurvivesReopen(t *testing.T) {
+	s := mem.New()
+
+	pq, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+
+	var b Batch
+	b.Put("x", []byte("hello"))
+	b.Put("y", []byte("world"))
+
+	if err := pq.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := pq.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	pq2, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("reopen NewStorage: %v", err)
+	}
+	defer pq2.Close()
+
+	v, err := pq2.Get("x")
+	if err != nil || string(v) != "hello" {
+		t.Fatalf("Get x after reopen = %q, %v; want %q, nil", v, err, "hello")
+	}
+
+	v, err = pq2.Get("y")
+	if err != nil || string(v) != "world" {
+		t.Fatalf("Get y after reopen = %q, %v; want %q, nil", v, err, "world")
+	}
+}
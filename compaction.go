@@ -0,0 +1,259 @@
+package caskdb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ligadous/caskdb/storage"
+)
+
+const (
+	TIMETOCOMPACT = 2e9 // background compaction tick
+
+	defaultCompactionActiveShare = 0.5
+	defaultCompactionMinBlocks   = 2
+	defaultCompactionConcurrency = 1
+)
+
+// CompactionStats is a point-in-time snapshot of the background
+// compactor, returned by (*PQ).CompactionStats.
+type CompactionStats struct {
+	Runs         int64
+	BlocksMerged int64
+	KeysMoved    int64
+	LastRunAt    time.Time
+	LastErr      error
+}
+
+// SetCompactionTrigger controls which immutable blocks the background
+// compactor picks up: a block is a candidate once its live-key share
+// (relative to its size when it was last rotated/started, see
+// blockSize) drops below activeShare, and a compaction pass only runs
+// once at least minBlocks blocks qualify.
+func (pq *PQ) SetCompactionTrigger(activeShare float64, minBlocks int) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	pq.compactionActiveShare = activeShare
+	pq.compactionMinBlocks = minBlocks
+}
+
+// SetCompactionConcurrency caps how many blocks a single compaction
+// pass merges.
+func (pq *PQ) SetCompactionConcurrency(n int) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	pq.compactionConcurrency = n
+}
+
+// CompactionStats returns a snapshot of the compactor's progress.
+func (pq *PQ) CompactionStats() CompactionStats {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.compactionStats
+}
+
+// Compact runs the background compactor, merging sparse immutable
+// blocks into the active one. It never returns; PQ starts it
+// alongside Flush, Rotate and Garbage.
+func (pq *PQ) Compact() {
+	for {
+		time.Sleep(TIMETOCOMPACT)
+
+		pq.checkCompaction()
+	}
+}
+
+type compactionCandidate struct {
+	file  string
+	share float64
+}
+
+// checkCompaction picks the sparsest immutable blocks and merges
+// their still-live records into the active block, then retires the
+// sources through the same backup path checkGarbage uses.
+func (pq *PQ) checkCompaction() {
+	pq.RLock()
+	active := pq.File
+	activeShare := pq.compactionActiveShare
+	minBlocks := pq.compactionMinBlocks
+	concurrency := pq.compactionConcurrency
+	blockSize := make(map[string]int64, len(*pq.blockSize))
+	for f, sz := range *pq.blockSize {
+		blockSize[f] = sz
+	}
+	countF := *pq.CountFile
+	pq.RUnlock()
+
+	if activeShare <= 0 {
+		activeShare = defaultCompactionActiveShare
+	}
+	if minBlocks <= 0 {
+		minBlocks = defaultCompactionMinBlocks
+	}
+	if concurrency <= 0 {
+		concurrency = defaultCompactionConcurrency
+	}
+
+	candidates := make([]compactionCandidate, 0)
+
+	for f, size := range blockSize {
+		if f == active || size == 0 {
+			continue
+		}
+
+		share := float64(countF[f]) / float64(size)
+		if share < activeShare {
+			candidates = append(candidates, compactionCandidate{f, share})
+		}
+	}
+
+	if len(candidates) < minBlocks {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].share < candidates[j].share })
+
+	if len(candidates) > concurrency {
+		candidates = candidates[:concurrency]
+	}
+
+	var lastErr error
+	merged := 0
+
+	for _, c := range candidates {
+		if err := pq.mergeBlock(c.file); err != nil {
+			lastErr = err
+			continue
+		}
+		merged++
+	}
+
+	pq.Lock()
+	pq.compactionStats.Runs++
+	pq.compactionStats.BlocksMerged += int64(merged)
+	pq.compactionStats.LastRunAt = time.Now()
+	pq.compactionStats.LastErr = lastErr
+	pq.Unlock()
+}
+
+// mergeBlock copies every record still live in f into the active
+// block, then retires f. Copying happens under read locks so it
+// interleaves with live Puts; recopy only takes the write lock to
+// append the copy and swap the Key entry, and skips the remap
+// entirely if the key was rewritten out from under it mid-merge.
+func (pq *PQ) mergeBlock(f string) error {
+	pq.RLock()
+	memkey := *pq.Key
+
+	type liveKey struct {
+		key    string
+		offset int64
+	}
+
+	live := make([]liveKey, 0)
+	for key, rec := range memkey {
+		if rec.File == f && rec.Offset != nil {
+			live = append(live, liveKey{key, *rec.Offset})
+		}
+	}
+	pq.RUnlock()
+
+	moved := 0
+
+	for _, lk := range live {
+		pq.RLock()
+		_, data, _, err := pq.GetOff(lk.offset, f)
+		pq.RUnlock()
+
+		if err != nil {
+			// A key this merge still believes is live in f couldn't be
+			// read back -- abort rather than retire f below and lose
+			// its only copy, the same way a failed recopy aborts.
+			return err
+		}
+
+		ok, err := pq.recopy(lk.key, f, lk.offset, data)
+		if err != nil {
+			return err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	pq.Lock()
+	pq.compactionStats.KeysMoved += int64(moved)
+	pq.Unlock()
+
+	return pq.retireBlock(f)
+}
+
+// recopy appends data for key into the active block, then remaps
+// memkey[key] to the new location -- but only if key is still exactly
+// where it was read from (same file and offset). If a live Put moved
+// or deleted it in the meantime, nothing is written and ok is false.
+func (pq *PQ) recopy(key, srcFile string, srcOffset int64, data []byte) (ok bool, err error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	rec := pq.encodeRecordFor(pq.File, key, data)
+
+	memkey := *pq.Key
+	countF := *pq.CountFile
+
+	cur := memkey[key]
+	if cur == nil || cur.File != srcFile || cur.Offset == nil || *cur.Offset != srcOffset {
+		return false, nil
+	}
+
+	pool := *pq.PoolFH
+	offtemp := pq.CurOffset
+
+	if _, err := pool[pq.File].W.Write(rec); err != nil {
+		return false, err
+	}
+	pq.CurOffset += int64(len(rec))
+
+	countF[cur.File]--
+	memkey[key] = &Rec{pq.File, &offtemp}
+	countF[pq.File]++
+
+	return true, nil
+}
+
+// retireBlock closes and removes f, the same way checkGarbage retires
+// a block whose keys were all overwritten or deleted -- moved into
+// the backup folder and gzipped rather than deleted outright.
+func (pq *PQ) retireBlock(f string) error {
+	pq.Lock()
+
+	if pq.File == f {
+		// Never retire the active block out from under ongoing writes.
+		pq.Unlock()
+		return nil
+	}
+
+	delete(*pq.CountFile, f)
+	delete(*pq.blockSize, f)
+	delete(*pq.blockVersion, f)
+
+	poolf := *pq.PoolFH
+	if recFH := poolf[f]; recFH != nil {
+		if recFH.W != nil {
+			recFH.W.Close()
+		}
+		if recFH.R != nil {
+			recFH.R.Close()
+		}
+	}
+	delete(poolf, f)
+
+	pq.Unlock()
+
+	pq.storage.Remove(storage.FileDesc{Kind: storage.KindHint, Num: f})
+
+	return pq.storage.Remove(storage.FileDesc{Kind: storage.KindData, Num: f})
+}
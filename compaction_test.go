@@ -0,0 +1,50 @@
+package caskdb
+
+import (
+	"testing"
+
+	"github.com/ligadous/caskdb/storage/mem"
+)
+
+// Regression test: mergeBlock used to swallow a GetOff error for a key
+// it still believed was live in the source block, then retire that
+// block anyway -- destroying the key's only copy. It must now abort
+// the whole merge instead.
+func TestMergeBlockAbortsOnReadError(t *testing.T) {
+	pq, err := NewStorage("", mem.New())
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	defer pq.Close()
+
+	pq.MaxSize(1)
+
+	if err := pq.Put("a", []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	oldFile := pq.File
+	pq.checkNewBlock()
+	if pq.File == oldFile {
+		t.Fatalf("rotation did not happen, still on block %s", oldFile)
+	}
+
+	// Inject a bogus live-key entry pointing at an offset that was
+	// never actually written in oldFile, to force GetOff to fail.
+	memkey := *pq.Key
+	bogusOffset := int64(1 << 30)
+	memkey["ghost"] = &Rec{oldFile, &bogusOffset}
+	(*pq.CountFile)[oldFile]++
+
+	if err := pq.mergeBlock(oldFile); err == nil {
+		t.Fatalf("mergeBlock: want error for unreadable key, got nil")
+	}
+
+	v, err := pq.Get("a")
+	if err != nil {
+		t.Fatalf("Get a after aborted merge: %v", err)
+	}
+	if string(v) != "1" {
+		t.Fatalf("Get a after aborted merge = %q, want %q", v, "1")
+	}
+}
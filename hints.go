@@ -0,0 +1,196 @@
+package caskdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ligadous/caskdb/storage"
+)
+
+// hintEntry is one record from a block's hint file: just enough to
+// rebuild the in-memory Key map without reading the block's values.
+type hintEntry struct {
+	key    string
+	offset int64
+}
+
+// hintPrefixLen is crc(10) + the ascii digit-widths of keysize,
+// valsize and offset, mirroring the size-of-size framing the v1
+// record format already uses.
+const hintPrefixLen = 10 + 1 + 1 + 1
+
+func encodeHintEntry(key string, offset int64, valsize int, crc []byte) []byte {
+	keysizeStr := fmt.Sprintf("%d", len(key))
+	valsizeStr := fmt.Sprintf("%d", valsize)
+	offsetStr := fmt.Sprintf("%d", offset)
+
+	var buf bytes.Buffer
+	buf.Write(crc)
+	buf.WriteString(fmt.Sprintf("%d", len(keysizeStr)))
+	buf.WriteString(fmt.Sprintf("%d", len(valsizeStr)))
+	buf.WriteString(fmt.Sprintf("%d", len(offsetStr)))
+	buf.WriteString(keysizeStr)
+	buf.WriteString(valsizeStr)
+	buf.WriteString(offsetStr)
+	buf.WriteString(" ")
+	buf.WriteString(key)
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
+
+// decodeHintEntry decodes the entry at offset. It returns io.EOF,
+// unwrapped, only for the clean case of offset sitting exactly at the
+// end of the file (no more entries); any other read failure, including
+// a partial read that starts an entry but can't finish it, is a
+// truncated/corrupt hint and comes back as a distinct wrapped error so
+// loadHint can tell the two apart.
+func decodeHintEntry(r storage.Reader, offset int64) (key string, recOffset int64, next int64, err error) {
+	prefix := make([]byte, hintPrefixLen)
+	n, err := r.ReadAt(prefix, offset)
+	if err == io.EOF && n == 0 {
+		return "", 0, 0, io.EOF
+	}
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("caskdb: truncated hint entry at offset %d: %w", offset, err)
+	}
+
+	szKeysize, _ := strconv.Atoi(string(prefix[10:11]))
+	szValsize, _ := strconv.Atoi(string(prefix[11:12]))
+	szOffset, _ := strconv.Atoi(string(prefix[12:13]))
+
+	lens := make([]byte, szKeysize+szValsize+szOffset)
+	n2, err := r.ReadAt(lens, offset+int64(n))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("caskdb: truncated hint entry at offset %d: %w", offset, err)
+	}
+
+	keysize, err := strconv.Atoi(string(lens[:szKeysize]))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("caskdb: truncated hint entry at offset %d: %w", offset, err)
+	}
+
+	recOffset, err = strconv.ParseInt(string(lens[szKeysize+szValsize:]), 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("caskdb: truncated hint entry at offset %d: %w", offset, err)
+	}
+
+	rest := make([]byte, 1+keysize+1) // " " + key + "\n"
+	n3, err := r.ReadAt(rest, offset+int64(n)+int64(n2))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("caskdb: truncated hint entry at offset %d: %w", offset, err)
+	}
+
+	next = offset + int64(n) + int64(n2) + int64(n3)
+
+	return string(rest[1 : 1+keysize]), recOffset, next, nil
+}
+
+// writeHint snapshots the keys currently live in file f into a
+// sibling hint file, so a future Start() can load f without scanning
+// its values. Called once f stops being the active block, which also
+// makes this the moment we can finally census f's true size for
+// checkCompaction: blockSize can't be known while f is still being
+// written, since Start() only ever saw it empty.
+func (pq *PQ) writeHint(f string) error {
+	pq.RLock()
+	memkey := *pq.Key
+
+	type liveKey struct {
+		key    string
+		offset int64
+	}
+
+	live := make([]liveKey, 0)
+	for key, rec := range memkey {
+		if rec.File == f && rec.Offset != nil {
+			live = append(live, liveKey{key, *rec.Offset})
+		}
+	}
+	pq.RUnlock()
+
+	var buf bytes.Buffer
+	for _, lk := range live {
+		_, data, _, err := pq.GetOff(lk.offset, f)
+		if err != nil {
+			continue
+		}
+
+		buf.Write(encodeHintEntry(lk.key, lk.offset, len(data), makeCheckSum(&data)))
+	}
+
+	w, err := pq.storage.Create(storage.FileDesc{Kind: storage.KindHint, Num: f})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	pq.Lock()
+	(*pq.blockSize)[f] = int64(len(live))
+	pq.Unlock()
+
+	return nil
+}
+
+// loadHint reads every entry out of f's hint file. ok is false when
+// there is no hint, or it stops decoding cleanly before reaching the
+// end of some partial/corrupt entry; callers should fall back to a
+// full scan of f in that case.
+func (pq *PQ) loadHint(f string) (entries []hintEntry, ok bool) {
+	r, err := pq.storage.Open(storage.FileDesc{Kind: storage.KindHint, Num: f})
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+
+	entries = make([]hintEntry, 0)
+	var offset int64
+
+	for {
+		key, recOffset, next, err := decodeHintEntry(r, offset)
+		if err == io.EOF {
+			// Clean end of the hint file: every entry decoded so far
+			// (possibly none, for a block with no live keys) is good.
+			return entries, true
+		}
+		if err != nil {
+			return nil, false
+		}
+
+		entries = append(entries, hintEntry{key, recOffset})
+		offset = next
+	}
+}
+
+// RebuildHints regenerates the hint file for every immutable (i.e.
+// not currently active) data block. Use it to recover after a hint
+// was lost, or to backfill hints for blocks written before this
+// feature existed.
+func (pq *PQ) RebuildHints() error {
+	pq.RLock()
+	active := pq.File
+	pq.RUnlock()
+
+	fds, err := pq.storage.List(storage.KindData)
+	if err != nil {
+		return err
+	}
+
+	for _, fd := range fds {
+		if fd.Num == active {
+			continue
+		}
+
+		if err := pq.writeHint(fd.Num); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package caskdb
+
+import (
+	"sort"
+	"strings"
+)
+
+// IteratorOptions filters and bounds the keys a NewIterator walks.
+type IteratorOptions struct {
+	// Prefix, if non-empty, restricts iteration to keys sharing it.
+	Prefix string
+	// Start, if non-empty, skips keys that sort before it.
+	Start string
+	// Limit caps the number of keys returned. <= 0 means unlimited.
+	Limit int
+}
+
+// Iterator walks a point-in-time snapshot of PQ's key map in sorted
+// key order. Values are loaded lazily via GetOff only when Value is
+// called, rather than all at once the way ListKeys/ListAllKeys
+// materialize their whole result. Modeled on goleveldb's
+// iterator.Iterator.
+//
+// An Iterator is not safe for concurrent use, and should be Released
+// once the caller is done with it.
+type Iterator struct {
+	pq      *PQ
+	keys    []string
+	recs    map[string]*Rec
+	limit   int
+	pos     int
+	value   []byte
+	haveVal bool
+	err     error
+}
+
+// NewIterator snapshots pq's key map under lock (copying *pq.Key once,
+// as the type doc promises) and returns an Iterator over the keys
+// matching opts. Puts after the snapshot don't change what the
+// iterator sees; they just aren't visible until a new iterator is
+// created.
+func (pq *PQ) NewIterator(opts IteratorOptions) *Iterator {
+	pq.RLock()
+	memkey := *pq.Key
+
+	keys := make([]string, 0, len(memkey))
+	recs := make(map[string]*Rec, len(memkey))
+
+	for k, rec := range memkey {
+		if opts.Prefix != "" && !strings.HasPrefix(k, opts.Prefix) {
+			continue
+		}
+		if opts.Start != "" && k < opts.Start {
+			continue
+		}
+
+		keys = append(keys, k)
+		recs[k] = rec
+	}
+	pq.RUnlock()
+
+	sort.Strings(keys)
+
+	return &Iterator{
+		pq:    pq,
+		keys:  keys,
+		recs:  recs,
+		limit: opts.Limit,
+		pos:   -1,
+	}
+}
+
+// Next advances the iterator to its next key, returning false once the
+// snapshot (or opts.Limit) is exhausted.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.limit > 0 && it.pos+1 >= it.limit {
+		return false
+	}
+
+	it.pos++
+	it.haveVal = false
+	it.value = nil
+
+	return it.pos < len(it.keys)
+}
+
+// Key returns the key at the iterator's current position.
+func (it *Iterator) Key() string {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return ""
+	}
+
+	return it.keys[it.pos]
+}
+
+// Value reads the value for the iterator's current key, loading it
+// from storage on first call and caching it for any further calls at
+// the same position.
+func (it *Iterator) Value() []byte {
+	if it.haveVal {
+		return it.value
+	}
+
+	key := it.Key()
+	rec := it.recs[key]
+	if rec == nil || rec.Offset == nil {
+		return nil
+	}
+
+	it.pq.Lock()
+	_, data, _, err := it.pq.GetOff(*rec.Offset, rec.File)
+	it.pq.Unlock()
+
+	if err != nil {
+		it.err = err
+		return nil
+	}
+
+	it.value = data
+	it.haveVal = true
+
+	return it.value
+}
+
+// Err returns the first error Value encountered, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Release frees the iterator's snapshot. The iterator must not be used
+// afterwards.
+func (it *Iterator) Release() {
+	it.keys = nil
+	it.recs = nil
+}
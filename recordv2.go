@@ -0,0 +1,170 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// v2 is the binary record format: a fixed 17-byte header followed by
+// the raw key and value bytes, no ascii framing. It replaces the
+// human-readable v1 header (MAGICNUMBER + ascii crc + ascii
+// size-of-size + key/value) for any block rotated in after this
+// version, lifting v1's 9-digit cap on key/value lengths and giving
+// tombstones (ktype) a dedicated byte instead of an empty value.
+//
+//	[magic u16][version u8][flags u8][crc32 u32][keylen u32][vallen u32][ktype u8][key][val]
+//
+// Existing v1 blocks keep loading: Start() sniffs the first record of
+// each block once and records its version, and every read/write for
+// that block is routed through the matching codec from then on.
+const (
+	magicV2 uint16 = 0xCA5C
+
+	version1 byte = 1
+	version2 byte = 2
+
+	// keyTypeVal/keyTypeDel mirror leveldb's keyType byte: a value
+	// record vs. a tombstone. v1 has no equivalent -- it represents a
+	// delete as an empty value -- so v1 reads/writes keep doing that
+	// for compatibility; only v2 records carry ktype on the wire.
+	keyTypeDel byte = 0
+	keyTypeVal byte = 1
+
+	v2HeaderLen = 2 + 1 + 1 + 4 + 4 + 4 + 1 // = 17
+)
+
+// encodeRecordV2 lays out key/data in the v2 binary format. data ==
+// nil is written as a keyTypeDel tombstone with no body; anything
+// else, including a non-nil empty slice, is a keyTypeVal record.
+func encodeRecordV2(key string, data []byte) []byte {
+	ktype := keyTypeVal
+	if data == nil {
+		ktype = keyTypeDel
+		data = []byte{}
+	}
+
+	header := make([]byte, v2HeaderLen)
+	binary.BigEndian.PutUint16(header[0:2], magicV2)
+	header[2] = version2
+	header[3] = 0 // flags, reserved
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(data)))
+	header[16] = ktype
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	buf.WriteString(key)
+	buf.Write(data)
+
+	return buf.Bytes()
+}
+
+// getOffV2 is the v2 counterpart to GetOff's v1 decode path.
+func (pq *PQ) getOffV2(offset int64, file string) ([]byte, []byte, int64, error) {
+	pool := *pq.PoolFH
+	R := pool[file].R
+
+	header := make([]byte, v2HeaderLen)
+	n, err := R.ReadAt(header, offset)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if binary.BigEndian.Uint16(header[0:2]) != magicV2 {
+		return nil, nil, 0, fmt.Errorf("caskdb: bad v2 magic at offset %d of %s", offset, file)
+	}
+
+	crc := binary.BigEndian.Uint32(header[4:8])
+	keylen := binary.BigEndian.Uint32(header[8:12])
+	vallen := binary.BigEndian.Uint32(header[12:16])
+	ktype := header[16]
+
+	body := make([]byte, int(keylen)+int(vallen))
+	n2, err := R.ReadAt(body, offset+int64(n))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	key := body[:keylen]
+	val := body[keylen:]
+
+	if crc32.ChecksumIEEE(val) != crc {
+		return nil, nil, 0, fmt.Errorf("caskdb: failed checksum at offset %d of %s", offset, file)
+	}
+
+	next := offset + int64(n) + int64(n2)
+
+	if ktype == keyTypeDel {
+		return key, nil, next, nil
+	}
+
+	return key, val, next, nil
+}
+
+// detectBlockVersion sniffs the first record of file to decide which
+// codec owns it going forward. A block with no data yet (freshly
+// created, about to be rotated in) is new and gets v2; anything else
+// is dispatched on its leading bytes: v1 records start with
+// MAGICNUMBER ("R3C"), which can never collide with the v2 magic.
+//
+// BATCHMAGIC ("R3CB") shares its first 3 bytes with MAGICNUMBER, and
+// is written verbatim by both codecs (the batch header itself is
+// unversioned ascii), so a block opening with a batch would otherwise
+// always be misread as v1. When the leading bytes are BATCHMAGIC,
+// this skips the batch header and sniffs the first sub-record inside
+// it instead.
+func (pq *PQ) detectBlockVersion(file string) byte {
+	pool := *pq.PoolFH
+	rf := pool[file]
+	if rf == nil || rf.R == nil {
+		return version2
+	}
+
+	batchHead := make([]byte, len(BATCHMAGIC))
+	if _, err := rf.R.ReadAt(batchHead, 0); err == nil && string(batchHead) == BATCHMAGIC {
+		return pq.sniffMagic(rf, int64(batchHeaderLen))
+	}
+
+	return pq.sniffMagic(rf, 0)
+}
+
+// sniffMagic reads the codec magic at offset and classifies it.
+func (pq *PQ) sniffMagic(rf *RecFH, offset int64) byte {
+	head := make([]byte, len(MAGICNUMBER))
+	if _, err := rf.R.ReadAt(head, offset); err != nil {
+		return version2
+	}
+
+	if string(head) == MAGICNUMBER {
+		return version1
+	}
+
+	return version2
+}
+
+// blockVersionOf returns the codec version in effect for file,
+// defaulting to v2 for files Start() hasn't recorded yet. Like
+// blockSize/CountFile, the map is only ever written with pq's write
+// lock held (Start, checkGarbage, retireBlock); callers read it without
+// locking, consistent with how GetOff already reads PoolFH unguarded.
+func (pq *PQ) blockVersionOf(file string) byte {
+	v, ok := (*pq.blockVersion)[file]
+	if !ok {
+		return version2
+	}
+
+	return v
+}
+
+// encodeRecordFor encodes key/data using whichever format file was
+// detected to use.
+func (pq *PQ) encodeRecordFor(file string, key string, data []byte) []byte {
+	if pq.blockVersionOf(file) == version1 {
+		return encodeRecord(key, data)
+	}
+
+	return encodeRecordV2(key, data)
+}
@@ -0,0 +1,54 @@
+package caskdb
+
+import (
+	"testing"
+
+	"github.com/ligadous/caskdb/storage/mem"
+)
+
+// Regression test: a block whose first persisted record is a Batch
+// used to be misdetected as v1 on reopen, because BATCHMAGIC shares
+// its first 3 bytes with MAGICNUMBER. Every record in the block would
+// then fail its v1 checksum and Start() would silently stop indexing.
+func TestDetectBlockVersionSniffsPastBatchHeader(t *testing.T) {
+	s := mem.New()
+
+	pq, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+
+	var b Batch
+	b.Put("a", []byte("1"))
+	b.Put("b", []byte("2"))
+
+	if err := pq.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := pq.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	pq2, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("reopen NewStorage: %v", err)
+	}
+	defer pq2.Close()
+
+	v, err := pq2.Get("a")
+	if err != nil {
+		t.Fatalf("Get a after reopen: %v", err)
+	}
+	if string(v) != "1" {
+		t.Fatalf("Get a after reopen = %q, want %q", v, "1")
+	}
+
+	v, err = pq2.Get("b")
+	if err != nil {
+		t.Fatalf("Get b after reopen: %v", err)
+	}
+	if string(v) != "2" {
+		t.Fatalf("Get b after reopen = %q, want %q", v, "2")
+	}
+}
@@ -197,24 +197,34 @@ func (this *SQueue) retrieve(key string) ([]byte, error) {
 	return this.pq.Get(key)
 }
 
+// refresh warms the cache for the 200000-key window starting at
+// currentReadKey. It walks a single snapshot Iterator rather than
+// probing pq.Get for all 200000 synthetic keys in the window one by
+// one -- most of which don't exist, since keys are only ever consumed
+// going forward.
 func (this *SQueue) refresh(currentReadKey string) error {
-	var i uint64
-
 	ikey, _ := strconv.ParseUint(currentReadKey, KEYS_BASE, 64)
 
-	for i = 0; i < 200000; i++ {
-		key := strconv.FormatUint(ikey+i, KEYS_BASE)
+	it := this.pq.NewIterator(IteratorOptions{})
+	defer it.Release()
 
-		rec, err := this.pq.Get(key)
+	for it.Next() {
+		key := it.Key()
 
-		if err != nil || rec == nil || len(rec) == 0 {
+		k, err := strconv.ParseUint(key, KEYS_BASE, 64)
+		if err != nil || k < ikey || k >= ikey+200000 {
+			continue
+		}
+
+		rec := it.Value()
+		if rec == nil || len(rec) == 0 {
 			continue
 		}
 
 		this.cache.Add(rec, this.ttl, key)
 	}
 
-	return nil
+	return it.Err()
 }
 
 func (this *SQueue) Pop() (rec []byte, rKey string, empty bool, err error) {
@@ -0,0 +1,191 @@
+// Package file is the on-disk storage.Storage implementation: the
+// same layout PQ has always written, now behind the Storage interface
+// so it can be swapped out (see storage/mem) without touching PQ.
+package file
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ligadous/caskdb/storage"
+)
+
+const (
+	bkpFolder  = ".bkp"
+	hintSuffix = ".hint"
+	lockFile   = ".lock"
+)
+
+// Storage is a storage.Storage backed by a directory on disk.
+type Storage struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// New prepares dir (and its backup folder) and returns a Storage
+// rooted there.
+func New(dir string) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0766); err != nil {
+		return nil, fmt.Errorf("storage/file: MkdirAll %s: %s", dir, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, bkpFolder), 0766); err != nil {
+		return nil, fmt.Errorf("storage/file: MkdirAll %s: %s", dir, err)
+	}
+
+	return &Storage{dir: dir}, nil
+}
+
+func (s *Storage) path(fd storage.FileDesc) string {
+	switch fd.Kind {
+	case storage.KindHint:
+		return filepath.Join(s.dir, fd.Num+hintSuffix)
+	case storage.KindBackup:
+		return filepath.Join(s.dir, bkpFolder, fd.Num)
+	default:
+		return filepath.Join(s.dir, fd.Num)
+	}
+}
+
+// Create opens fd for append, creating it if necessary. The returned
+// *os.File satisfies storage.Writer directly.
+func (s *Storage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	f, err := os.OpenFile(s.path(fd), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0766)
+	if err != nil {
+		return nil, fmt.Errorf("storage/file: open %s: %s", fd.Num, err)
+	}
+	return f, nil
+}
+
+// Open opens fd for random reads. *os.File already implements
+// io.ReaderAt, so it satisfies storage.Reader directly.
+func (s *Storage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	f, err := os.Open(s.path(fd))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Remove retires fd. Data blocks follow the historical PQ behavior:
+// they are moved into the .bkp folder and gzipped in the background
+// rather than deleted outright. Hint and backup files are removed
+// directly.
+func (s *Storage) Remove(fd storage.FileDesc) error {
+	if fd.Kind != storage.KindData {
+		return os.Remove(s.path(fd))
+	}
+
+	bkpPath := filepath.Join(s.dir, bkpFolder, fd.Num)
+	if err := os.Rename(s.path(fd), bkpPath); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := exec.Command("gzip", bkpPath).Run(); err != nil {
+			fmt.Println("storage/file: failed gzip:", err, bkpPath)
+		}
+	}()
+
+	return nil
+}
+
+// Rename moves src to dst within the same directory.
+func (s *Storage) Rename(src, dst storage.FileDesc) error {
+	return os.Rename(s.path(src), s.path(dst))
+}
+
+// List returns the file descriptors present for kind, sorted
+// numerically for KindData and KindHint.
+func (s *Storage) List(kind storage.Kind) ([]storage.FileDesc, error) {
+	dir := s.dir
+	if kind == storage.KindBackup {
+		dir = filepath.Join(s.dir, bkpFolder)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nums := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+
+		switch kind {
+		case storage.KindHint:
+			if len(name) > len(hintSuffix) && name[len(name)-len(hintSuffix):] == hintSuffix {
+				nums = append(nums, name[:len(name)-len(hintSuffix)])
+			}
+		case storage.KindBackup:
+			nums = append(nums, name)
+		default:
+			if name == bkpFolder || name == lockFile || (len(name) > len(hintSuffix) && name[len(name)-len(hintSuffix):] == hintSuffix) {
+				continue
+			}
+			nums = append(nums, name)
+		}
+	}
+
+	fds := make([]storage.FileDesc, len(nums))
+	for i, n := range nums {
+		fds[i] = storage.FileDesc{Kind: kind, Num: n}
+	}
+
+	storage.SortByNum(fds)
+
+	return fds, nil
+}
+
+// Lock acquires a process-level lock over the directory via an
+// exclusively-created lock file.
+func (s *Storage) Lock() (storage.Locker, error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("storage/file: already locked: %s", err)
+	}
+	return &fileLock{f: f, path: f.Name()}, nil
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+// CleanBackups removes files under the backup folder last modified
+// more than olderThan ago.
+func (s *Storage) CleanBackups(olderThan time.Duration) error {
+	dir := filepath.Join(s.dir, bkpFolder)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		if time.Since(info.ModTime()) > olderThan {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	return nil
+}
+
+type fileLock struct {
+	f    *os.File
+	path string
+}
+
+func (l *fileLock) Unlock() error {
+	l.f.Close()
+	return os.Remove(l.path)
+}
+
@@ -0,0 +1,52 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ligadous/caskdb/storage"
+)
+
+func TestCleanBackupsRemovesOldEntriesOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caskdb-file-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// Put "old" and "new" backups straight into the backup folder.
+	// Retiring data blocks through Remove would gzip them in the
+	// background, renaming them to "<num>.gz" at an unpredictable time.
+	for _, num := range []string{"old", "new"} {
+		w, err := s.Create(storage.FileDesc{Kind: storage.KindBackup, Num: num})
+		if err != nil {
+			t.Fatalf("Create %s: %v", num, err)
+		}
+		w.Close()
+	}
+
+	oldPath := filepath.Join(dir, bkpFolder, "old")
+	oldTime := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(oldPath, oldTime, oldTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	if err := s.CleanBackups(24 * time.Hour); err != nil {
+		t.Fatalf("CleanBackups: %v", err)
+	}
+
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Fatalf("old backup should have been removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, bkpFolder, "new")); err != nil {
+		t.Fatalf("new backup should still exist: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Package mem is an in-memory storage.Storage, for unit tests and
+// embedders that want a caskdb entirely in RAM (no filesystem, no
+// gzip step). Nothing written here ever survives process exit.
+package mem
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ligadous/caskdb/storage"
+)
+
+type volume struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// Storage is an in-memory storage.Storage. The zero value is not
+// usable; use New.
+type Storage struct {
+	mu      sync.Mutex
+	volumes map[storage.FileDesc]*volume
+}
+
+// New returns an empty in-memory Storage.
+func New() *Storage {
+	return &Storage{volumes: make(map[storage.FileDesc]*volume)}
+}
+
+func (s *Storage) volume(fd storage.FileDesc) *volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := s.volumes[fd]
+	if v == nil {
+		v = &volume{}
+		s.volumes[fd] = v
+	}
+	return v
+}
+
+func (s *Storage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	return &writer{vol: s.volume(fd)}, nil
+}
+
+func (s *Storage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	s.mu.Lock()
+	v, ok := s.volumes[fd]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("storage/mem: no such file %s/%s", fd.Kind, fd.Num)
+	}
+
+	return &reader{vol: v}, nil
+}
+
+func (s *Storage) Remove(fd storage.FileDesc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.volumes, fd)
+	return nil
+}
+
+func (s *Storage) Rename(src, dst storage.FileDesc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.volumes[src]
+	if !ok {
+		return fmt.Errorf("storage/mem: no such file %s/%s", src.Kind, src.Num)
+	}
+
+	delete(s.volumes, src)
+	s.volumes[dst] = v
+	return nil
+}
+
+func (s *Storage) List(kind storage.Kind) ([]storage.FileDesc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fds := make([]storage.FileDesc, 0)
+	for fd := range s.volumes {
+		if fd.Kind == kind {
+			fds = append(fds, fd)
+		}
+	}
+
+	storage.SortByNum(fds)
+
+	return fds, nil
+}
+
+func (s *Storage) Lock() (storage.Locker, error) {
+	return noopLocker{}, nil
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+// CleanBackups is a no-op: storage/mem keeps no backup files (Remove
+// deletes volumes outright) and nothing here survives process exit
+// anyway.
+func (s *Storage) CleanBackups(olderThan time.Duration) error {
+	return nil
+}
+
+type noopLocker struct{}
+
+func (noopLocker) Unlock() error { return nil }
+
+type writer struct {
+	vol *volume
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.vol.mu.Lock()
+	defer w.vol.mu.Unlock()
+
+	w.vol.data = append(w.vol.data, p...)
+	return len(p), nil
+}
+
+func (w *writer) Close() error { return nil }
+func (w *writer) Sync() error  { return nil }
+
+type reader struct {
+	vol *volume
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	r.vol.mu.RLock()
+	defer r.vol.mu.RUnlock()
+
+	if off >= int64(len(r.vol.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.vol.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *reader) Close() error { return nil }
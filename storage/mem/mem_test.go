@@ -0,0 +1,41 @@
+package mem
+
+import (
+	"testing"
+
+	"github.com/ligadous/caskdb/storage"
+)
+
+// Regression test: List used to return map-iteration order, which is
+// randomized per run. NewStorage relies on List's ordering to find the
+// newest data block (it Starts every entry in List order and leaves
+// the last one active), so an unsorted List silently picks the wrong
+// active block on reopen.
+func TestListOrdersByNum(t *testing.T) {
+	s := New()
+
+	for _, num := range []string{"10", "2", "1"} {
+		w, err := s.Create(storage.FileDesc{Kind: storage.KindData, Num: num})
+		if err != nil {
+			t.Fatalf("Create %s: %v", num, err)
+		}
+		w.Close()
+	}
+
+	for i := 0; i < 20; i++ {
+		fds, err := s.List(storage.KindData)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+
+		want := []string{"1", "2", "10"}
+		if len(fds) != len(want) {
+			t.Fatalf("List = %+v, want %d entries", fds, len(want))
+		}
+		for j, fd := range fds {
+			if fd.Num != want[j] {
+				t.Fatalf("List[%d] = %q, want %q (full: %+v)", j, fd.Num, want[j], fds)
+			}
+		}
+	}
+}
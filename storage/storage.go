@@ -0,0 +1,102 @@
+// Package storage defines the backend contract PQ uses to persist its
+// blocks, decoupling it from any concrete transport. It mirrors the
+// split goleveldb uses between storage.Storage and storage.FileDesc,
+// so PQ can run against a real directory (storage/file) or an
+// in-memory volume (storage/mem) without changing its own logic.
+package storage
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Kind identifies the role a file plays in a PQ directory.
+type Kind int
+
+const (
+	KindData Kind = iota
+	KindBackup
+	KindHint
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindData:
+		return "data"
+	case KindBackup:
+		return "backup"
+	case KindHint:
+		return "hint"
+	}
+	return "unknown"
+}
+
+// FileDesc names a single file within a Storage, independent of how
+// that Storage chooses to lay it out on disk (or in memory).
+type FileDesc struct {
+	Kind Kind
+	Num  string
+}
+
+// Writer is an append-only, syncable handle to a file being written.
+type Writer interface {
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+// Reader is a random-access handle to a file being read.
+type Reader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Locker releases a process-level lock acquired with Storage.Lock.
+type Locker interface {
+	Unlock() error
+}
+
+// Storage is the backend PQ talks to instead of the filesystem
+// directly. Implementations live in subpackages: storage/file for the
+// on-disk layout PQ has always used, storage/mem for in-memory volumes
+// used by tests and embedders that want to run entirely in RAM.
+type Storage interface {
+	Create(fd FileDesc) (Writer, error)
+	Open(fd FileDesc) (Reader, error)
+	Remove(fd FileDesc) error
+	Rename(src, dst FileDesc) error
+
+	// List returns every file of kind known to this Storage, ordered
+	// by FileDesc.Num interpreted as a non-negative integer (see
+	// SortByNum). NewStorage relies on this ordering to find the
+	// newest data block: it calls Start for every KindData entry in
+	// List order and leaves the last one active.
+	List(kind Kind) ([]FileDesc, error)
+	Lock() (Locker, error)
+	Close() error
+
+	// CleanBackups removes backed-up data blocks (see Remove) last
+	// modified more than olderThan ago. Implementations with no
+	// meaningful notion of backup age or retention (storage/mem, which
+	// keeps no backups at all) may treat this as a no-op.
+	CleanBackups(olderThan time.Duration) error
+}
+
+// SortByNum sorts fds in place to satisfy List's ordering contract:
+// ascending by FileDesc.Num interpreted as a non-negative integer,
+// falling back to a plain string comparison for any Num that isn't
+// one (e.g. storage/file's KindBackup entries, which carry a .gz
+// suffix once gzipped). Storage implementations should
+// run their List results through this before returning them.
+func SortByNum(fds []FileDesc) {
+	sort.Slice(fds, func(i, j int) bool {
+		a, erra := strconv.Atoi(fds[i].Num)
+		b, errb := strconv.Atoi(fds[j].Num)
+		if erra != nil || errb != nil {
+			return fds[i].Num < fds[j].Num
+		}
+		return a < b
+	})
+}
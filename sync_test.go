@@ -0,0 +1,63 @@
+package caskdb
+
+import (
+	"testing"
+
+	"github.com/ligadous/caskdb/storage"
+	"github.com/ligadous/caskdb/storage/mem"
+)
+
+// syncCountingStorage wraps another Storage to count fsyncs on the
+// writers it creates, so tests can observe whether a SyncPolicy
+// actually fired.
+type syncCountingStorage struct {
+	storage.Storage
+	syncs *int
+}
+
+type syncCountingWriter struct {
+	storage.Writer
+	syncs *int
+}
+
+func (w *syncCountingWriter) Sync() error {
+	*w.syncs++
+	return w.Writer.Sync()
+}
+
+func (s *syncCountingStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingWriter{w, s.syncs}, nil
+}
+
+// Regression test: (*PQ).Write (the Batch commit path) never consulted
+// SyncPolicy, so SyncAlways/SyncEveryN were silent no-ops for any
+// caller using the Batch API.
+func TestWriteBatchHonorsSyncAlways(t *testing.T) {
+	syncs := 0
+	s := &syncCountingStorage{Storage: mem.New(), syncs: &syncs}
+
+	pq, err := NewStorage("", s)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	defer pq.Close()
+
+	pq.SetSyncPolicy(SyncAlways())
+	syncs = 0 // ignore any fsyncs from setup writes
+
+	var b Batch
+	b.Put("a", []byte("1"))
+	b.Put("b", []byte("2"))
+
+	if err := pq.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if syncs == 0 {
+		t.Fatalf("Write with SyncAlways: want at least one Sync call, got 0")
+	}
+}